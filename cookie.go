@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+)
+
+// cookieSecretRotateInterval is how often the MAC secret is replaced;
+// the previous secret is kept for one more interval so a cookie issued
+// just before rotation still validates.
+const cookieSecretRotateInterval = 120 * time.Second
+
+// cookieSize is the truncated length of the HMAC-SHA256 cookies we hand
+// out and the body MACs senders compute with them.
+const cookieSize = 16
+
+// CookieChecker hands out and validates return-routability cookies for
+// senders we're not yet willing to spend an Ed25519 verification on.
+type CookieChecker struct {
+	mu         sync.Mutex
+	secret     [32]byte
+	prevSecret [32]byte
+	rotatedAt  time.Time
+}
+
+func NewCookieChecker() *CookieChecker {
+	c := &CookieChecker{rotatedAt: time.Now()}
+	cryptorand.Read(c.secret[:])
+	return c
+}
+
+func (c *CookieChecker) rotateLocked() {
+	if time.Since(c.rotatedAt) < cookieSecretRotateInterval {
+		return
+	}
+	c.prevSecret = c.secret
+	cryptorand.Read(c.secret[:])
+	c.rotatedAt = time.Now()
+}
+
+// Issue returns the cookie for (pubKey, addr) under the current secret.
+func (c *CookieChecker) Issue(pubKey ed25519.PublicKey, addr net.Addr) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotateLocked()
+	return addrMAC(c.secret[:], pubKey, addr)
+}
+
+// Valid reports whether bodyMAC_ was computed with bodyMAC from a cookie we
+// issued to (pubKey, addr) under the current or previous secret.
+func (c *CookieChecker) Valid(bodyMAC_ []byte, payload []byte, pubKey ed25519.PublicKey, addr net.Addr) bool {
+	c.mu.Lock()
+	cur := addrMAC(c.secret[:], pubKey, addr)
+	prev := addrMAC(c.prevSecret[:], pubKey, addr)
+	c.rotateLocked()
+	c.mu.Unlock()
+	return subtle.ConstantTimeCompare(bodyMAC_, bodyMAC(cur, payload)) == 1 ||
+		subtle.ConstantTimeCompare(bodyMAC_, bodyMAC(prev, payload)) == 1
+}
+
+func addrMAC(secret []byte, pubKey ed25519.PublicKey, addr net.Addr) []byte {
+	return truncatedHMAC(secret, pubKey, []byte(addr.String()))
+}
+
+// bodyMAC authenticates payload under cookie, so a sender holding a
+// cookie can prove it without a full Ed25519 signature check.
+func bodyMAC(cookie []byte, payload []byte) []byte {
+	return truncatedHMAC(cookie, payload)
+}
+
+func truncatedHMAC(key []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	sum := h.Sum(nil)
+	return sum[:cookieSize]
+}
+
+// Raw frames on the wire are tagged with a 1-byte kind so the receive
+// loop can tell a msgCookieReply from a signed Envelope without first
+// gob-decoding it as one.
+const (
+	frameEnvelope byte = iota
+	frameCookieReply
+)
+
+// CookieReply answers an unknown sender while we're under load, naming
+// the cookie they should key Envelope.CookieMAC with (see bodyMAC) on
+// their next msgSendBall. It isn't signed, so ForPubKey/ForAddr are just routing
+// hints the sender can cheaply self-check before trusting the reply.
+type CookieReply struct {
+	From      NodeID
+	ForPubKey ed25519.PublicKey
+	ForAddr   string
+	Cookie    []byte
+}
+
+// LoadTracker keeps an EWMA of inbound packets per second so the receive
+// loop can tell whether it's under enough load to start demanding
+// cookies.
+type LoadTracker struct {
+	mu        sync.Mutex
+	ewma      float64
+	count     int
+	windowEnd time.Time
+}
+
+const (
+	loadWindow     = time.Second
+	loadThreshold  = 100.0 // packets/sec considered "under load"
+	loadEWMAWeight = 0.5
+)
+
+func NewLoadTracker() *LoadTracker {
+	return &LoadTracker{windowEnd: time.Now().Add(loadWindow)}
+}
+
+// Mark records one inbound packet and reports whether we're under load.
+func (t *LoadTracker) Mark() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count++
+	if now := time.Now(); now.After(t.windowEnd) {
+		t.ewma = loadEWMAWeight*float64(t.count) + (1-loadEWMAWeight)*t.ewma
+		t.count = 0
+		t.windowEnd = now.Add(loadWindow)
+	}
+	return t.ewma > loadThreshold
+}
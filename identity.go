@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxClockSkew bounds how far a sender's envelope timestamp may drift
+// before a frame is dropped as suspect.
+const maxClockSkew = 5 * time.Second
+
+// NodeID is the SHA-256 digest of a node's Ed25519 public key.
+type NodeID [sha256.Size]byte
+
+func (id NodeID) String() string { return hex.EncodeToString(id[:]) }
+
+func nodeIDFromPubKey(pub ed25519.PublicKey) NodeID {
+	return sha256.Sum256(pub)
+}
+
+// loadOrCreateNodeKey reads a hex-encoded Ed25519 seed from path, or
+// generates and persists one if path doesn't exist yet. An empty path
+// yields an ephemeral identity that isn't written to disk.
+func loadOrCreateNodeKey(path string) (ed25519.PrivateKey, error) {
+	if path != "" {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+			if err != nil {
+				return nil, fmt.Errorf("nodekey %s: %v", path, err)
+			}
+			return ed25519.NewKeyFromSeed(seed), nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	_, priv, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := writeNodeKey(path, priv); err != nil {
+			return nil, err
+		}
+	}
+	return priv, nil
+}
+
+func writeNodeKey(path string, priv ed25519.PrivateKey) error {
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())), 0600)
+}
+
+// genKey generates a fresh node key, writes it to path and prints the
+// resulting node ID.
+func genKey(path string) {
+	_, priv, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		log.Fatal("genkey:", err)
+	}
+	if err := writeNodeKey(path, priv); err != nil {
+		log.Fatal("genkey:", err)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	fmt.Printf("wrote node key to %s, id=%s\n", path, nodeIDFromPubKey(pub))
+	os.Exit(0)
+}
+
+// Envelope wraps every multicast frame with the sender's public key, a
+// strictly increasing nonce, and a signature, so the receiver can
+// authenticate the frame before trusting its payload.
+type Envelope struct {
+	PubKey    ed25519.PublicKey
+	Nonce     uint64
+	Timestamp int64
+	Payload   []byte
+	Signature []byte
+
+	// CookieMAC proves the sender holds a cookie we issued for
+	// (PubKey, source address): HMAC(cookie, Payload). Only checked
+	// under load (see cookie.go); not covered by signedBytes, since the
+	// sender may not have held the cookie yet when it first signed.
+	CookieMAC []byte
+}
+
+func signEnvelope(priv ed25519.PrivateKey, nonce uint64, payload []byte) Envelope {
+	env := Envelope{
+		PubKey:    priv.Public().(ed25519.PublicKey),
+		Nonce:     nonce,
+		Timestamp: time.Now().Unix(),
+		Payload:   payload,
+	}
+	env.Signature = ed25519.Sign(priv, env.signedBytes())
+	return env
+}
+
+func (e Envelope) signedBytes() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(e.PubKey)
+	binary.Write(buf, binary.BigEndian, e.Nonce)
+	binary.Write(buf, binary.BigEndian, e.Timestamp)
+	buf.Write(e.Payload)
+	return buf.Bytes()
+}
+
+// verify checks the envelope's signature and timestamp and, if valid,
+// returns the NodeID derived from the embedded public key.
+func (e Envelope) verify() (NodeID, bool) {
+	if len(e.PubKey) != ed25519.PublicKeySize || len(e.Signature) != ed25519.SignatureSize {
+		return NodeID{}, false
+	}
+	if skew := time.Since(time.Unix(e.Timestamp, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return NodeID{}, false
+	}
+	if !ed25519.Verify(e.PubKey, e.signedBytes(), e.Signature) {
+		return NodeID{}, false
+	}
+	return nodeIDFromPubKey(e.PubKey), true
+}
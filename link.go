@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxTCPFrameLen bounds the length prefix on a tcpLink frame, so a
+// corrupt or hostile stream can't make us allocate an enormous buffer.
+const maxTCPFrameLen = 64 * 1024
+
+// tcpDialBackoffMax caps how long tcpLink waits between redial attempts
+// to a --peer address that isn't answering.
+const tcpDialBackoffMax = 30 * time.Second
+
+// tcpWriteTimeout bounds how long a single Write to a tcpLink connection
+// may block, so one stalled or malicious peer can't wedge Send/SendTo
+// for the rest of the swarm while l.mu is held.
+const tcpWriteTimeout = 2 * time.Second
+
+// maxDialTargets bounds how many distinct addresses a tcpLink will ever
+// track in dialing, so a peer that gossips msgPeerList entries for an
+// unbounded number of distinct addresses can't make us leak a dialLoop
+// goroutine per address for the life of the process.
+const maxDialTargets = 64
+
+// linkFrame is one fully-framed message received over a Link, tagged
+// with the address it arrived from and the Link it arrived over, so a
+// reply can be unicast back the same way without broadcasting it to
+// every other peer.
+type linkFrame struct {
+	data []byte
+	addr net.Addr
+	link Link
+}
+
+// Link is a transport that signed envelope frames can travel across.
+// Multicast doesn't cross most L3 boundaries, so a node can also carry
+// the same frames over point-to-point TCP connections to explicitly
+// configured peers.
+type Link interface {
+	// Send broadcasts frame to everything this link is currently
+	// connected to.
+	Send(frame []byte)
+	// SendTo unicasts frame back to addr over this link only, e.g. to
+	// answer a single sender without leaking the reply to everyone else
+	// on the link.
+	SendTo(addr net.Addr, frame []byte)
+	// Frames is where fully-framed inbound messages arrive.
+	Frames() <-chan linkFrame
+}
+
+// Links fans a frame out across every configured Link and merges their
+// inbound frames into one channel, so callers don't need to care which
+// transport a message actually arrived over.
+type Links struct {
+	links  []Link
+	frames chan linkFrame
+}
+
+func NewLinks(links ...Link) *Links {
+	ls := &Links{links: links, frames: make(chan linkFrame, 64)}
+	for _, l := range links {
+		go func(l Link) {
+			for f := range l.Frames() {
+				ls.frames <- f
+			}
+		}(l)
+	}
+	return ls
+}
+
+func (ls *Links) Send(frame []byte) {
+	for _, l := range ls.links {
+		l.Send(frame)
+	}
+}
+
+func (ls *Links) Frames() <-chan linkFrame { return ls.frames }
+
+// multicastLink is the UDP multicast transport: one datagram is one
+// frame, so no extra framing is needed. It sends and receives over
+// whichever of IPv4/IPv6 its Bind has joined.
+type multicastLink struct {
+	bind    *Bind
+	limiter *RateLimiter
+	frames  chan linkFrame
+}
+
+// newMulticastLink joins group4 and/or group6 on iface (either may be
+// nil to disable that family). onDrop, if non-nil, is called whenever
+// the rate limiter drops an inbound packet.
+func newMulticastLink(iface *net.Interface, group4, group6 *net.UDPAddr, onDrop func()) (*multicastLink, error) {
+	bind, err := newBind(iface, group4, group6)
+	if err != nil {
+		return nil, err
+	}
+	limiter := NewRateLimiter()
+	limiter.OnDrop = onDrop
+	l := &multicastLink{
+		bind:    bind,
+		limiter: limiter,
+		frames:  make(chan linkFrame, 64),
+	}
+	go l.receive()
+	return l, nil
+}
+
+func (l *multicastLink) receive() {
+	for f := range l.bind.Frames() {
+		if !l.limiter.Allow(f.addr) {
+			continue
+		}
+		l.frames <- linkFrame{data: f.data, addr: f.addr, link: l}
+	}
+}
+
+func (l *multicastLink) Send(frame []byte) {
+	l.bind.Send(frame)
+}
+
+func (l *multicastLink) SendTo(addr net.Addr, frame []byte) {
+	l.bind.SendTo(addr, frame)
+}
+
+func (l *multicastLink) Frames() <-chan linkFrame { return l.frames }
+
+// tcpLink hands frames off over TCP to the bootstrap peers, to addresses
+// learned from msgPeerList gossip and to inbound connections, framed
+// with a 4-byte big-endian length prefix.
+type tcpLink struct {
+	mu      sync.Mutex
+	conns   map[string]net.Conn
+	dialing map[string]bool
+	limiter *RateLimiter
+	frames  chan linkFrame
+}
+
+// newTCPLink optionally listens on listenAddr for inbound connections,
+// and dials each of peers at startup (and again, with backoff, on
+// failure or disconnect). onDrop, if non-nil, is called whenever the
+// rate limiter drops an inbound frame.
+func newTCPLink(listenAddr string, peers []string, onDrop func()) (*tcpLink, error) {
+	limiter := NewRateLimiter()
+	limiter.OnDrop = onDrop
+	l := &tcpLink{
+		conns:   make(map[string]net.Conn),
+		dialing: make(map[string]bool),
+		limiter: limiter,
+		frames:  make(chan linkFrame, 64),
+	}
+	if listenAddr != "" {
+		ln, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		go l.acceptLoop(ln)
+	}
+	for _, addr := range peers {
+		l.dial(addr)
+	}
+	return l, nil
+}
+
+// dial starts a dial-and-retry loop for addr unless one is already
+// running, so repeated msgPeerList gossip about the same address is a
+// no-op. Once maxDialTargets distinct addresses are already tracked, new
+// ones are dropped rather than started.
+func (l *tcpLink) dial(addr string) {
+	l.mu.Lock()
+	already := l.dialing[addr]
+	if !already && len(l.dialing) >= maxDialTargets {
+		l.mu.Unlock()
+		return
+	}
+	l.dialing[addr] = true
+	l.mu.Unlock()
+	if !already {
+		go l.dialLoop(addr)
+	}
+}
+
+func (l *tcpLink) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("tcp accept:", err)
+			continue
+		}
+		go l.serve(conn)
+	}
+}
+
+func (l *tcpLink) dialLoop(addr string) {
+	backoff := time.Second
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > tcpDialBackoffMax {
+				backoff = tcpDialBackoffMax
+			}
+			continue
+		}
+		backoff = time.Second
+		l.serve(conn) // blocks until the connection drops, then we redial
+	}
+}
+
+// serve registers conn and reads length-prefixed frames from it until it
+// closes or a frame is malformed.
+func (l *tcpLink) serve(conn net.Conn) {
+	key := conn.RemoteAddr().String()
+	l.mu.Lock()
+	l.conns[key] = conn
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, key)
+		l.mu.Unlock()
+		conn.Close()
+	}()
+
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if n == 0 || n > maxTCPFrameLen {
+			return
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if !l.limiter.Allow(conn.RemoteAddr()) {
+			continue
+		}
+		l.frames <- linkFrame{data: buf, addr: conn.RemoteAddr(), link: l}
+	}
+}
+
+func (l *tcpLink) Send(frame []byte) {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(frame)))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, conn := range l.conns {
+		conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		if _, err := conn.Write(lenBuf[:]); err != nil {
+			delete(l.conns, key)
+			conn.Close()
+			continue
+		}
+		if _, err := conn.Write(frame); err != nil {
+			delete(l.conns, key)
+			conn.Close()
+		}
+	}
+}
+
+// SendTo unicasts frame to the single connection associated with addr, if
+// any is still open. Unlike Send, it never broadcasts to the rest of the
+// swarm, so it's safe for replies (e.g. cookie replies) that must only
+// reach the peer that's actually at addr.
+func (l *tcpLink) SendTo(addr net.Addr, frame []byte) {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(frame)))
+
+	l.mu.Lock()
+	conn, ok := l.conns[addr.String()]
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	if _, err := conn.Write(lenBuf[:]); err != nil {
+		l.mu.Lock()
+		delete(l.conns, addr.String())
+		l.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if _, err := conn.Write(frame); err != nil {
+		l.mu.Lock()
+		delete(l.conns, addr.String())
+		l.mu.Unlock()
+		conn.Close()
+	}
+}
+
+func (l *tcpLink) Frames() <-chan linkFrame { return l.frames }
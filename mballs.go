@@ -11,6 +11,7 @@ package main
 import (
 	"bytes"
 	gc "code.google.com/p/goncurses"
+	"crypto/ed25519"
 	"encoding/gob"
 	"flag"
 	"fmt"
@@ -19,28 +20,49 @@ import (
 	"net"
 	"os"
 	"sort"
+	"strings"
 	"time"
 )
 
-var (
-	ipv4Addr = &net.UDPAddr{
-		IP:   net.ParseIP("224.1.2.3"),
-		Port: 7777,
-	}
-)
-
 const (
 	msgWantBall = iota
 	msgSendBall
 	msgTakeBall
+	msgPeerList
 )
 
-func listen(iface *net.Interface) (*net.UDPConn, error) {
-	conn, err := net.ListenMulticastUDP("udp", iface, ipv4Addr)
-	if err != nil {
-		log.Fatal("multicast create:", err)
-	}
-	return conn, err
+// PeerAddr is one entry in a msgPeerList gossip message: enough for a
+// recipient to dial addr over TCP and introduce itself.
+type PeerAddr struct {
+	ID   NodeID
+	Addr string
+}
+
+// peerAddrGossipSize caps how many peers we advertise in one msgPeerList,
+// so the gossip message doesn't grow with swarm size.
+const peerAddrGossipSize = 5
+
+// addrList collects repeated -peer flags into a slice.
+type addrList []string
+
+func (a *addrList) String() string     { return strings.Join(*a, ",") }
+func (a *addrList) Set(v string) error { *a = append(*a, v); return nil }
+
+// incomingBall pairs a ball received over msgSendBall with the NodeID of
+// whoever signed the envelope it arrived in and that envelope's counter,
+// so the main loop can run it through the sender's replay filter.
+type incomingBall struct {
+	ball  *Ball
+	from  NodeID
+	nonce uint64
+}
+
+// peerSighting is a msgWantBall heard from the network, paired with the
+// envelope counter it arrived with.
+type peerSighting struct {
+	info  PeerInfo
+	addr  net.Addr
+	nonce uint64
 }
 
 const ball_height = 4
@@ -127,26 +149,30 @@ func (s *Ball) Update(my, mx int, offedge func(obj Object)) {
 }
 
 type PeerInfo struct {
-	ID   byte
-	Name string
+	ID     NodeID
+	PubKey ed25519.PublicKey
+	Name   string
 }
 
 type Peer struct {
 	info      PeerInfo
 	addr      net.Addr
 	lastHeard time.Time
+	replay    ReplayFilter
 }
 
-var allPeers map[byte]*Peer = make(map[byte]*Peer)
+var allPeers map[NodeID]*Peer = make(map[NodeID]*Peer)
 
 // PeerSlice attaches the methods of Interface to []*Peer, sorting in increasing order of id.
 type PeerSlice []*Peer
 
-func (p PeerSlice) Len() int           { return len(p) }
-func (p PeerSlice) Less(i, j int) bool { return p[i].info.ID < p[j].info.ID }
-func (p PeerSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p PeerSlice) Len() int { return len(p) }
+func (p PeerSlice) Less(i, j int) bool {
+	return bytes.Compare(p[i].info.ID[:], p[j].info.ID[:]) < 0
+}
+func (p PeerSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
-//---
+// ---
 type Peers struct {
 	w *gc.Window
 }
@@ -176,7 +202,7 @@ func (p *Peers) Draw(w *gc.Window) {
 	}
 	sort.Sort(peers)
 	for i, peer := range peers {
-		w.MovePrintln(i+1, 0, peer.addr, peer.info.Name)
+		w.MovePrintln(i+1, 0, peer.addr, peer.info.Name, peer.info.ID.String()[:8])
 	}
 	w.Overlay(p.w)
 }
@@ -219,9 +245,32 @@ func findInterface(ifaceName string) (iface *net.Interface, err error) {
 	if 0 == (net.FlagUp & iface.Flags) {
 		return iface, fmt.Errorf("Interface %s is not up", ifaceName)
 	}
+	if 0 == (net.FlagMulticast & iface.Flags) {
+		return iface, fmt.Errorf("Interface %s does not support multicast", ifaceName)
+	}
 	return
 }
 
+// hasIPv6LinkLocal reports whether iface has an IPv6 link-local address
+// configured, which is required before we can join an IPv6 multicast
+// group on it.
+func hasIPv6LinkLocal(iface *net.Interface) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 	f, err := os.Create("err.log")
 	if err != nil {
@@ -232,16 +281,51 @@ func main() {
 	log.SetOutput(f)
 
 	var (
-		ifaceName string
+		ifaceName   string
+		nodekeyPath string
+		genkey      bool
+		tcpListen   string
+		peers       addrList
+		group4Flag  string
+		group6Flag  string
+		port        int
 	)
 	flag.StringVar(&ifaceName, "iface", "", "name of interface for multicasting")
+	flag.StringVar(&nodekeyPath, "nodekey", "", "file holding this node's Ed25519 private key (generated if missing)")
+	flag.BoolVar(&genkey, "genkey", false, "generate a node key at -nodekey and exit")
+	flag.StringVar(&tcpListen, "tcp-listen", "", "address to accept inbound TCP peer connections on")
+	flag.Var(&peers, "peer", "host:port of a bootstrap peer to dial over TCP (repeatable)")
+	flag.StringVar(&group4Flag, "group4", defaultGroup4, "IPv4 multicast group address (empty disables IPv4)")
+	flag.StringVar(&group6Flag, "group6", defaultGroup6, "IPv6 link-local multicast group address (empty disables IPv6)")
+	flag.IntVar(&port, "port", defaultPort, "UDP port for multicast")
 	flag.Parse()
+	if genkey {
+		if nodekeyPath == "" {
+			log.Fatal("-genkey requires -nodekey")
+		}
+		genKey(nodekeyPath)
+	}
 	var iface *net.Interface = nil
 	if ifaceName != "" {
 		iface, err = EnsureInterface(ifaceName, 5)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if group6Flag != "" && !hasIPv6LinkLocal(iface) {
+			log.Printf("interface %s has no IPv6 link-local address, disabling IPv6 multicast", ifaceName)
+			group6Flag = ""
+		}
+	}
+	var group4, group6 *net.UDPAddr
+	if group4Flag != "" {
+		group4 = &net.UDPAddr{IP: net.ParseIP(group4Flag), Port: port}
+	}
+	if group6Flag != "" {
+		zone := ""
+		if iface != nil {
+			zone = iface.Name
+		}
+		group6 = &net.UDPAddr{IP: net.ParseIP(group6Flag), Port: port, Zone: zone}
 	}
 
 	var stdscr *gc.Window
@@ -272,64 +356,169 @@ func main() {
 	}()
 
 	rand.Seed(time.Now().Unix())
-	myID := byte(rand.Intn(256))
 
-	conn, _ := listen(iface)
-	ball_incoming := make(chan Object)
-	ball_wanted := make(chan *Peer)
+	nodekey, err := loadOrCreateNodeKey(nodekeyPath)
+	if err != nil {
+		log.Fatal("nodekey:", err)
+	}
+	myPubKey := nodekey.Public().(ed25519.PublicKey)
+	myID := nodeIDFromPubKey(myPubKey)
+	sendNonce, err := loadNonceCounter(nodekeyPath)
+	if err != nil {
+		log.Fatal("noncecounter:", err)
+	}
+
+	mcLink, err := newMulticastLink(iface, group4, group6, nil)
+	if err != nil {
+		log.Fatal("multicast link:", err)
+	}
+	tcLink, err := newTCPLink(tcpListen, peers, nil)
+	if err != nil {
+		log.Fatal("tcp link:", err)
+	}
+	links := NewLinks(mcLink, tcLink)
+
+	loadTracker := NewLoadTracker()
+	cookieChecker := NewCookieChecker()
+	// sendCookieReply unicasts reply back over the link the triggering
+	// frame arrived on, to the address it arrived from. It must never go
+	// out via links.Send: broadcasting a cookie to the whole multicast
+	// group (or every TCP peer) would let anyone listening learn the
+	// cookie without proving they actually own addr, defeating the
+	// return-routability check entirely.
+	sendCookieReply := func(link Link, addr net.Addr, reply CookieReply) {
+		buf := new(bytes.Buffer)
+		buf.WriteByte(frameCookieReply)
+		if err := gob.NewEncoder(buf).Encode(reply); err != nil {
+			log.Println("encode cookie reply:", err)
+			return
+		}
+		link.SendTo(addr, buf.Bytes())
+	}
+
+	ball_incoming := make(chan incomingBall)
+	ball_wanted := make(chan peerSighting)
+	cookie_learned := make(chan CookieReply)
 	go func() {
-		const UDPbufSize = 1024
-		m := make([]byte, UDPbufSize)
-		for {
-			n, addr, err := conn.ReadFrom(m)
-			if err != nil {
-				log.Fatal("multicast read:", err)
+		for f := range links.Frames() {
+			if len(f.data) == 0 {
+				continue
 			}
-			if n > 0 {
-				reader := bytes.NewReader(m[1:])
-				decoder := gob.NewDecoder(reader)
-				switch m[0] {
-				case msgWantBall:
-					var info PeerInfo
-					decoder.Decode(&info)
-					if info.ID != myID {
-						ball_wanted <- &Peer{info, addr, time.Now()}
-					}
-				case msgSendBall:
-					var ball Ball
-					var id byte
-					decoder.Decode(&id)
-					if id == myID {
-						decoder.Decode(&ball)
-						ball_incoming <- &ball
-					}
-				case msgTakeBall:
+			kind, body := f.data[0], f.data[1:]
+			underLoad := loadTracker.Mark()
+			if kind == frameCookieReply {
+				var reply CookieReply
+				if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&reply); err != nil {
+					continue
+				}
+				if !bytes.Equal(reply.ForPubKey, myPubKey) {
+					continue
+				}
+				cookie_learned <- reply
+				continue
+			}
+			var env Envelope
+			if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&env); err != nil {
+				continue
+			}
+			if len(env.Payload) == 0 {
+				continue
+			}
+			// Gate the expensive Ed25519 check behind a cheap cookie MAC
+			// once we're under load, so a flood of bogus msgSendBall
+			// frames can't pin a core on signature verification alone.
+			if underLoad && env.Payload[0] == msgSendBall {
+				if !cookieChecker.Valid(env.CookieMAC, env.Payload, env.PubKey, f.addr) {
+					sendCookieReply(f.link, f.addr, CookieReply{
+						From:      myID,
+						ForPubKey: env.PubKey,
+						ForAddr:   f.addr.String(),
+						Cookie:    cookieChecker.Issue(env.PubKey, f.addr),
+					})
+					continue
+				}
+			}
+			fromID, ok := env.verify()
+			if !ok {
+				continue
+			}
+			reader := bytes.NewReader(env.Payload[1:])
+			decoder := gob.NewDecoder(reader)
+			switch env.Payload[0] {
+			case msgWantBall:
+				var info PeerInfo
+				decoder.Decode(&info)
+				if info.ID != fromID || !bytes.Equal(info.PubKey, env.PubKey) {
+					continue
+				}
+				if info.ID != myID {
+					ball_wanted <- peerSighting{info, f.addr, env.Nonce}
+				}
+			case msgSendBall:
+				var ball Ball
+				var id NodeID
+				decoder.Decode(&id)
+				if id == myID {
+					decoder.Decode(&ball)
+					ball_incoming <- incomingBall{&ball, fromID, env.Nonce}
+				}
+			case msgTakeBall:
+			case msgPeerList:
+				var addrs []PeerAddr
+				decoder.Decode(&addrs)
+				// A gossiping peer could otherwise hand us an unbounded
+				// list in one frame and have us dial all of it.
+				if len(addrs) > peerAddrGossipSize {
+					addrs = addrs[:peerAddrGossipSize]
+				}
+				for _, pa := range addrs {
+					tcLink.dial(pa.Addr)
 				}
 			}
 		}
 	}()
 
-	sendconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-	if err != nil {
-		log.Fatal("send socket create:", err)
-	}
-
 	pp := newPeers(0, 0)
 	objects = append(objects, pp)
 
+	// peerCookies holds the cookie most recently issued to us by each
+	// peer, keyed by that peer's NodeID, so sendBallTo can attach it to
+	// the next msgSendBall sent their way. Like allPeers, it's only ever
+	// touched from this goroutine, so it needs no lock.
+	peerCookies := make(map[NodeID][]byte)
+
+	send := func(msgType byte, body []byte, cookie []byte) {
+		payload := append([]byte{msgType}, body...)
+		n, err := sendNonce.Next()
+		if err != nil {
+			log.Println("nonce counter:", err)
+			return
+		}
+		env := signEnvelope(nodekey, n, payload)
+		if cookie != nil {
+			env.CookieMAC = bodyMAC(cookie, payload)
+		}
+		buf := new(bytes.Buffer)
+		buf.WriteByte(frameEnvelope)
+		if err := gob.NewEncoder(buf).Encode(env); err != nil {
+			log.Println("encode envelope:", err)
+			return
+		}
+		links.Send(buf.Bytes())
+	}
 	sendWant := func() {
 		buf := new(bytes.Buffer)
 		enc := gob.NewEncoder(buf)
 		hostname, _ := os.Hostname()
-		enc.Encode(PeerInfo{myID, hostname})
-		sendconn.WriteTo(append([]byte{msgWantBall}, buf.Bytes()...), ipv4Addr)
+		enc.Encode(PeerInfo{myID, myPubKey, hostname})
+		send(msgWantBall, buf.Bytes(), nil)
 	}
-	sendBallTo := func(ball Object, dest byte) {
+	sendBallTo := func(ball Object, dest NodeID) {
 		buf := new(bytes.Buffer)
 		enc := gob.NewEncoder(buf)
 		enc.Encode(dest)
 		enc.Encode(ball)
-		sendconn.WriteTo(append([]byte{msgSendBall}, buf.Bytes()...), ipv4Addr)
+		send(msgSendBall, buf.Bytes(), peerCookies[dest])
 		for i, o := range objects {
 			if o == ball {
 				objects = append(objects[:i], objects[i+1:]...)
@@ -338,6 +527,21 @@ func main() {
 		}
 		ball.Cleanup()
 	}
+	sendPeerList := func() {
+		var addrs []PeerAddr
+		for _, p := range allPeers {
+			if len(addrs) >= peerAddrGossipSize {
+				break
+			}
+			addrs = append(addrs, PeerAddr{p.info.ID, p.addr.String()})
+		}
+		if len(addrs) == 0 {
+			return
+		}
+		buf := new(bytes.Buffer)
+		gob.NewEncoder(buf).Encode(addrs)
+		send(msgPeerList, buf.Bytes(), nil)
+	}
 
 	addBall := func() {
 		ball := newBall(lines/2, cols/2, 0)
@@ -362,6 +566,7 @@ loop:
 		select {
 		case <-slowTicker.C:
 			sendWant()
+			sendPeerList()
 			for key, peer := range allPeers {
 				if peer.lastHeard.Add(time.Second).Before(time.Now()) {
 					delete(allPeers, key)
@@ -390,13 +595,23 @@ loop:
 				}
 			})
 			drawObjects(stdscr)
-		case peer := <-ball_wanted:
-			allPeers[peer.info.ID] = peer
+		case sighting := <-ball_wanted:
+			peer, known := allPeers[sighting.info.ID]
+			if !known {
+				peer = &Peer{}
+			}
+			if !peer.replay.Valid(sighting.nonce) {
+				continue
+			}
+			peer.info = sighting.info
+			peer.addr = sighting.addr
+			peer.lastHeard = time.Now()
+			allPeers[sighting.info.ID] = peer
 			for _, obj := range objects {
 				if ball, ok := obj.(*Ball); ok {
 					if ball.SpeedX() == 0 {
 						speed := 10
-						if peer.info.ID < myID {
+						if bytes.Compare(sighting.info.ID[:], myID[:]) < 0 {
 							speed = -10
 						}
 						ball.KickX(speed)
@@ -404,8 +619,12 @@ loop:
 					}
 				}
 			}
-		case ball := <-ball_incoming:
-			receiveBall(ball)
+		case in := <-ball_incoming:
+			if peer, known := allPeers[in.from]; known && peer.replay.Valid(in.nonce) {
+				receiveBall(in.ball)
+			}
+		case reply := <-cookie_learned:
+			peerCookies[reply.From] = reply.Cookie
 		case ch := <-input:
 			switch ch {
 			case 'b':
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// defaultGroup4, defaultGroup6 and defaultPort are the rendezvous point
+// nodes use unless --group4/--group6/--port say otherwise. Either
+// family can be switched off by passing an empty --group4/--group6.
+const (
+	defaultGroup4 = "224.1.2.3"
+	defaultGroup6 = "ff02::1234"
+	defaultPort   = 7777
+)
+
+// bindFrame is one datagram read off a Bind, tagged with the address
+// (and so the family) it arrived on.
+type bindFrame struct {
+	data []byte
+	addr net.Addr
+}
+
+// Bind joins an IPv4 and/or an IPv6 multicast group on the same
+// interface and receives from both concurrently, analogous to
+// WireGuard's conn.go Bind: the rest of the program just sees frames
+// and addresses, never which family carried them, so a swarm keeps
+// working on IPv6-only or mixed networks.
+type Bind struct {
+	pc4    *ipv4.PacketConn
+	group4 *net.UDPAddr
+	send4  *net.UDPConn
+
+	pc6    *ipv6.PacketConn
+	group6 *net.UDPAddr
+	send6  *net.UDPConn
+
+	frames chan bindFrame
+}
+
+// newBind joins group4 and/or group6 on iface. Either may be nil to
+// disable that family.
+func newBind(iface *net.Interface, group4, group6 *net.UDPAddr) (*Bind, error) {
+	b := &Bind{frames: make(chan bindFrame, 64)}
+	if group4 != nil {
+		recv, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", group4.Port))
+		if err != nil {
+			return nil, fmt.Errorf("bind ipv4: %v", err)
+		}
+		pc4 := ipv4.NewPacketConn(recv)
+		if err := pc4.JoinGroup(iface, group4); err != nil {
+			return nil, fmt.Errorf("join ipv4 group: %v", err)
+		}
+		send, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+		if err != nil {
+			return nil, fmt.Errorf("bind ipv4 send: %v", err)
+		}
+		b.pc4, b.group4, b.send4 = pc4, group4, send
+		go b.receive4()
+	}
+	if group6 != nil {
+		recv, err := net.ListenPacket("udp6", fmt.Sprintf(":%d", group6.Port))
+		if err != nil {
+			return nil, fmt.Errorf("bind ipv6: %v", err)
+		}
+		pc6 := ipv6.NewPacketConn(recv)
+		if err := pc6.JoinGroup(iface, group6); err != nil {
+			return nil, fmt.Errorf("join ipv6 group: %v", err)
+		}
+		send, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified, Port: 0})
+		if err != nil {
+			return nil, fmt.Errorf("bind ipv6 send: %v", err)
+		}
+		b.pc6, b.group6, b.send6 = pc6, group6, send
+		go b.receive6()
+	}
+	if b.pc4 == nil && b.pc6 == nil {
+		return nil, fmt.Errorf("bind: both ipv4 and ipv6 multicast are disabled")
+	}
+	return b, nil
+}
+
+func (b *Bind) receive4() {
+	const bufSize = 1024
+	m := make([]byte, bufSize)
+	for {
+		n, _, addr, err := b.pc4.ReadFrom(m)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		frame := make([]byte, n)
+		copy(frame, m[:n])
+		b.frames <- bindFrame{data: frame, addr: addr}
+	}
+}
+
+func (b *Bind) receive6() {
+	const bufSize = 1024
+	m := make([]byte, bufSize)
+	for {
+		n, _, addr, err := b.pc6.ReadFrom(m)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		frame := make([]byte, n)
+		copy(frame, m[:n])
+		b.frames <- bindFrame{data: frame, addr: addr}
+	}
+}
+
+// Send fans frame out to every family that's enabled.
+func (b *Bind) Send(frame []byte) {
+	if b.send4 != nil {
+		b.send4.WriteTo(frame, b.group4)
+	}
+	if b.send6 != nil {
+		b.send6.WriteTo(frame, b.group6)
+	}
+}
+
+func (b *Bind) Frames() <-chan bindFrame { return b.frames }
@@ -0,0 +1,340 @@
+// mweb is a program to demo multicast.
+// Run it multiple times on different machines/containers and each
+// instance will learn about the others through multicast.
+// Hit it via http on port 8080 and it will return a list of instances.
+// Flag --iface makes it use (and wait for) a particular interface (e.g. ethwe)
+// Flag -p makes it listen on a different http port
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	msgPeerInfo = iota
+	msgPeerList
+)
+
+// PeerAddr is one entry in a msgPeerList gossip message: enough for a
+// recipient to dial addr over TCP and introduce itself.
+type PeerAddr struct {
+	ID   NodeID
+	Addr string
+}
+
+// peerAddrGossipSize caps how many peers we advertise in one msgPeerList,
+// so the gossip message doesn't grow with swarm size.
+const peerAddrGossipSize = 5
+
+// addrList collects repeated -peer flags into a slice.
+type addrList []string
+
+func (a *addrList) String() string     { return strings.Join(*a, ",") }
+func (a *addrList) Set(v string) error { *a = append(*a, v); return nil }
+
+var (
+	peerCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "multicast",
+			Subsystem: "peers",
+			Name:      "total",
+			Help:      "The total number of multicast peers.",
+		},
+	)
+
+	rateLimitDrops = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "multicast",
+			Subsystem: "peers",
+			Name:      "ratelimit_drops_total",
+			Help:      "The total number of inbound packets dropped by the rate limiter.",
+		},
+	)
+)
+
+type PeerInfo struct {
+	ID     NodeID
+	PubKey ed25519.PublicKey
+	Name   string
+}
+
+type Peer struct {
+	info      PeerInfo
+	addr      net.Addr
+	lastHeard time.Time
+	replay    ReplayFilter
+}
+
+var allPeers map[NodeID]*Peer = make(map[NodeID]*Peer)
+var peersLock sync.Mutex
+
+func listPeers() []string {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	peers := []string{}
+	for _, p := range allPeers {
+		peers = append(peers, fmt.Sprintf("%s %s %s\n", p.info.Name, p.info.ID.String()[:8], p.addr))
+	}
+	peerCount.Set(float64(len(peers)))
+	return peers
+}
+
+func main() {
+	var (
+		ifaceName   string
+		httpPort    int
+		nodekeyPath string
+		genkey      bool
+		tcpListen   string
+		peers       addrList
+		group4Flag  string
+		group6Flag  string
+		port        int
+		err         error
+	)
+	flag.StringVar(&ifaceName, "iface", "eth0", "name of interface for multicasting")
+	flag.IntVar(&httpPort, "p", 8080, "port to listen for http")
+	flag.StringVar(&nodekeyPath, "nodekey", "", "file holding this node's Ed25519 private key (generated if missing)")
+	flag.BoolVar(&genkey, "genkey", false, "generate a node key at -nodekey and exit")
+	flag.StringVar(&tcpListen, "tcp-listen", "", "address to accept inbound TCP peer connections on")
+	flag.Var(&peers, "peer", "host:port of a bootstrap peer to dial over TCP (repeatable)")
+	flag.StringVar(&group4Flag, "group4", defaultGroup4, "IPv4 multicast group address (empty disables IPv4)")
+	flag.StringVar(&group6Flag, "group6", defaultGroup6, "IPv6 link-local multicast group address (empty disables IPv6)")
+	flag.IntVar(&port, "port", defaultPort, "UDP port for multicast")
+	flag.Parse()
+	if genkey {
+		if nodekeyPath == "" {
+			log.Fatal("-genkey requires -nodekey")
+		}
+		genKey(nodekeyPath)
+	}
+	var iface *net.Interface = nil
+	if ifaceName != "" {
+		iface, err = ensureInterface(ifaceName, 10)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if group6Flag != "" && !hasIPv6LinkLocal(iface) {
+			log.Printf("interface %s has no IPv6 link-local address, disabling IPv6 multicast", ifaceName)
+			group6Flag = ""
+		}
+	}
+	var group4, group6 *net.UDPAddr
+	if group4Flag != "" {
+		group4 = &net.UDPAddr{IP: net.ParseIP(group4Flag), Port: port}
+	}
+	if group6Flag != "" {
+		zone := ""
+		if iface != nil {
+			zone = iface.Name
+		}
+		group6 = &net.UDPAddr{IP: net.ParseIP(group6Flag), Port: port, Zone: zone}
+	}
+
+	rand.Seed(time.Now().Unix())
+	nodekey, err := loadOrCreateNodeKey(nodekeyPath)
+	if err != nil {
+		log.Fatal("nodekey:", err)
+	}
+	myPubKey := nodekey.Public().(ed25519.PublicKey)
+	myID := nodeIDFromPubKey(myPubKey)
+	sendNonce, err := loadNonceCounter(nodekeyPath)
+	if err != nil {
+		log.Fatal("noncecounter:", err)
+	}
+	mcLink, err := newMulticastLink(iface, group4, group6, rateLimitDrops.Inc)
+	if err != nil {
+		log.Fatal("multicast link:", err)
+	}
+	tcLink, err := newTCPLink(tcpListen, peers, rateLimitDrops.Inc)
+	if err != nil {
+		log.Fatal("tcp link:", err)
+	}
+	links := NewLinks(mcLink, tcLink)
+	go func() {
+		for f := range links.Frames() {
+			decodeReceived(f.addr, f.data, tcLink)
+		}
+	}()
+
+	prometheus.MustRegister(peerCount)
+	prometheus.MustRegister(rateLimitDrops)
+
+	ticker := time.NewTicker(time.Second)
+	slowerTicker := time.NewTicker(20 * time.Second)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				sendInfo(nodekey, myID, myPubKey, sendNonce, links)
+				sendPeerList(nodekey, sendNonce, links)
+				expirePeers()
+			case <-slowerTicker.C:
+				for _, p := range listPeers() {
+					log.Printf(p)
+				}
+			}
+		}
+	}()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintf(w, strings.Join(listPeers(), "\n"))
+	})
+	http.Handle("/metrics", promhttp.Handler())
+	err = http.ListenAndServe(fmt.Sprintf(":%d", httpPort), nil)
+	log.Fatal(err)
+}
+
+func send(nodekey ed25519.PrivateKey, nonce *NonceCounter, links *Links, msgType byte, body []byte) {
+	payload := append([]byte{msgType}, body...)
+	n, err := nonce.Next()
+	if err != nil {
+		log.Println("nonce counter:", err)
+		return
+	}
+	env := signEnvelope(nodekey, n, payload)
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(env); err != nil {
+		log.Println("encode envelope:", err)
+		return
+	}
+	links.Send(buf.Bytes())
+}
+
+func sendInfo(nodekey ed25519.PrivateKey, id NodeID, pubKey ed25519.PublicKey, nonce *NonceCounter, links *Links) {
+	hostname, _ := os.Hostname()
+	buf := new(bytes.Buffer)
+	gob.NewEncoder(buf).Encode(PeerInfo{id, pubKey, hostname})
+	send(nodekey, nonce, links, msgPeerInfo, buf.Bytes())
+}
+
+func sendPeerList(nodekey ed25519.PrivateKey, nonce *NonceCounter, links *Links) {
+	peersLock.Lock()
+	var addrs []PeerAddr
+	for _, p := range allPeers {
+		if len(addrs) >= peerAddrGossipSize {
+			break
+		}
+		addrs = append(addrs, PeerAddr{p.info.ID, p.addr.String()})
+	}
+	peersLock.Unlock()
+	if len(addrs) == 0 {
+		return
+	}
+	buf := new(bytes.Buffer)
+	gob.NewEncoder(buf).Encode(addrs)
+	send(nodekey, nonce, links, msgPeerList, buf.Bytes())
+}
+
+func decodeReceived(addr net.Addr, buf []byte, tcLink *tcpLink) {
+	var env Envelope
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&env); err != nil {
+		return
+	}
+	fromID, ok := env.verify()
+	if !ok || len(env.Payload) == 0 {
+		return
+	}
+	decoder := gob.NewDecoder(bytes.NewReader(env.Payload[1:]))
+	switch env.Payload[0] {
+	case msgPeerInfo:
+		var info PeerInfo
+		if err := decoder.Decode(&info); err != nil || info.ID != fromID || !bytes.Equal(info.PubKey, env.PubKey) {
+			return
+		}
+		peersLock.Lock()
+		defer peersLock.Unlock()
+		peer, known := allPeers[info.ID]
+		if !known {
+			peer = &Peer{}
+		}
+		if !peer.replay.Valid(env.Nonce) {
+			return
+		}
+		peer.info = info
+		peer.addr = addr
+		peer.lastHeard = time.Now()
+		allPeers[info.ID] = peer
+	case msgPeerList:
+		var addrs []PeerAddr
+		decoder.Decode(&addrs)
+		// A gossiping peer could otherwise hand us an unbounded list in
+		// one frame and have us dial all of it.
+		if len(addrs) > peerAddrGossipSize {
+			addrs = addrs[:peerAddrGossipSize]
+		}
+		for _, pa := range addrs {
+			tcLink.dial(pa.Addr)
+		}
+	}
+}
+
+// Take out anyone we haven't heard from in a while
+func expirePeers() {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	for key, peer := range allPeers {
+		if peer.lastHeard.Add(time.Second * 3).Before(time.Now()) {
+			delete(allPeers, key)
+		}
+	}
+}
+
+func ensureInterface(ifaceName string, wait int) (iface *net.Interface, err error) {
+	if iface, err = findInterface(ifaceName); err == nil || wait == 0 {
+		return
+	}
+	for ; err != nil && wait > 0; wait -= 1 {
+		time.Sleep(1 * time.Second)
+		iface, err = findInterface(ifaceName)
+	}
+	return
+}
+
+func findInterface(ifaceName string) (iface *net.Interface, err error) {
+	if iface, err = net.InterfaceByName(ifaceName); err != nil {
+		return iface, fmt.Errorf("Unable to find interface %s", ifaceName)
+	}
+	if 0 == (net.FlagUp & iface.Flags) {
+		return iface, fmt.Errorf("Interface %s is not up", ifaceName)
+	}
+	if 0 == (net.FlagMulticast & iface.Flags) {
+		return iface, fmt.Errorf("Interface %s does not support multicast", ifaceName)
+	}
+	return
+}
+
+// hasIPv6LinkLocal reports whether iface has an IPv6 link-local address
+// configured, which is required before we can join an IPv6 multicast
+// group on it.
+func hasIPv6LinkLocal(iface *net.Interface) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
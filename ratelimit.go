@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Token-bucket parameters for inbound multicast frames: a steady
+// trickle with a small burst on top.
+const (
+	rateLimitPacketsPerSecond = 200.0
+	rateLimitBurst            = 400.0
+	rateLimitSweepInterval    = time.Minute
+	rateLimitIdleTimeout      = 2 * time.Minute
+)
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// RateLimiter enforces a token-bucket limit per source IP on inbound
+// frames, so a flooding peer can't pin a core decoding gob or spam the
+// receive channels.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	// OnDrop, if set, is called whenever a packet is dropped, so callers
+	// can surface the drop count (e.g. as a Prometheus counter).
+	OnDrop func()
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow reports whether a packet from addr should be processed, consuming
+// one token from its bucket if so.
+func (r *RateLimiter) Allow(addr net.Addr) bool {
+	now := time.Now()
+	key := addrKey(addr)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sweep(now)
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rateLimitBurst, lastRefill: now}
+		r.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.lastRefill).Seconds() * rateLimitPacketsPerSecond
+		if b.tokens > rateLimitBurst {
+			b.tokens = rateLimitBurst
+		}
+		b.lastRefill = now
+	}
+
+	if b.tokens < 1 {
+		if r.OnDrop != nil {
+			r.OnDrop()
+		}
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets idle long enough that a fresh one would behave
+// identically, bounding the map's size under a flood from many sources.
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if now.Sub(b.lastRefill) > rateLimitIdleTimeout {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+func addrKey(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return addr.String()
+}
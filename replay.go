@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// replayWindowSize is the number of trailing counters we remember per
+// peer, modeled on WireGuard's replay.go.
+const replayWindowSize = 1024
+
+// ReplayFilter is a per-peer sliding-window replay filter: it accepts a
+// counter only once, and only if it isn't too far behind the highest
+// counter seen so far.
+type ReplayFilter struct {
+	started bool
+	last    uint64
+	bitmap  [replayWindowSize / 64]uint64
+}
+
+// Valid reports whether counter is acceptable under the current window. If
+// so, it marks the counter as seen and slides the window forward.
+func (f *ReplayFilter) Valid(counter uint64) bool {
+	if !f.started {
+		f.started = true
+		f.last = counter
+		f.set(counter)
+		return true
+	}
+	if counter+replayWindowSize <= f.last {
+		return false // too far in the past
+	}
+	if counter > f.last {
+		if counter-f.last > replayWindowSize {
+			f.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := f.last + 1; i < counter; i++ {
+				f.clear(i)
+			}
+		}
+		f.last = counter
+		f.set(counter)
+		return true
+	}
+	if f.isSet(counter) {
+		return false // duplicate
+	}
+	f.set(counter)
+	return true
+}
+
+func (f *ReplayFilter) slot(counter uint64) (word int, mask uint64) {
+	idx := counter % replayWindowSize
+	return int(idx / 64), 1 << (idx % 64)
+}
+
+func (f *ReplayFilter) set(counter uint64) {
+	w, m := f.slot(counter)
+	f.bitmap[w] |= m
+}
+
+func (f *ReplayFilter) clear(counter uint64) {
+	w, m := f.slot(counter)
+	f.bitmap[w] &^= m
+}
+
+func (f *ReplayFilter) isSet(counter uint64) bool {
+	w, m := f.slot(counter)
+	return f.bitmap[w]&m != 0
+}
+
+// NonceCounter is a monotonically increasing counter persisted next to a
+// node's key, so that a restart never reuses a value the other side might
+// already have accepted into its replay window.
+type NonceCounter struct {
+	path string
+	mu   sync.Mutex
+	n    uint64
+}
+
+// loadNonceCounter loads the counter stored alongside nodekeyPath, or
+// starts from zero if there is none yet. An empty nodekeyPath yields an
+// unpersisted, in-memory counter.
+func loadNonceCounter(nodekeyPath string) (*NonceCounter, error) {
+	if nodekeyPath == "" {
+		return &NonceCounter{}, nil
+	}
+	c := &NonceCounter{path: nodekeyPath + ".nonce"}
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("noncecounter %s: %v", c.path, err)
+	}
+	c.n = n
+	return c, nil
+}
+
+// Next returns the next counter value, persisting it first so a crash
+// between the write and the send can never cause a value to be reused.
+func (c *NonceCounter) Next() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	if c.path != "" {
+		if err := ioutil.WriteFile(c.path, []byte(strconv.FormatUint(c.n, 10)), 0600); err != nil {
+			return 0, err
+		}
+	}
+	return c.n, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestReplayFilterInOrder(t *testing.T) {
+	var f ReplayFilter
+	for i := uint64(0); i < 5; i++ {
+		if !f.Valid(i) {
+			t.Fatalf("counter %d: want accepted, got rejected", i)
+		}
+	}
+}
+
+func TestReplayFilterOutOfOrder(t *testing.T) {
+	var f ReplayFilter
+	for _, c := range []uint64{5, 3, 4, 1, 2} {
+		if !f.Valid(c) {
+			t.Fatalf("counter %d: want accepted, got rejected", c)
+		}
+	}
+}
+
+func TestReplayFilterDuplicate(t *testing.T) {
+	var f ReplayFilter
+	if !f.Valid(10) {
+		t.Fatal("counter 10: want accepted, got rejected")
+	}
+	if f.Valid(10) {
+		t.Fatal("counter 10 replayed: want rejected, got accepted")
+	}
+	if !f.Valid(11) {
+		t.Fatal("counter 11: want accepted, got rejected")
+	}
+	if f.Valid(10) {
+		t.Fatal("counter 10 replayed: want rejected, got accepted")
+	}
+}
+
+func TestReplayFilterFarPast(t *testing.T) {
+	var f ReplayFilter
+	if !f.Valid(replayWindowSize * 10) {
+		t.Fatal("initial high counter: want accepted, got rejected")
+	}
+	if f.Valid(1) {
+		t.Fatal("counter far outside the window: want rejected, got accepted")
+	}
+	if !f.Valid(replayWindowSize*10 + 1) {
+		t.Fatal("counter just past the window edge: want accepted, got rejected")
+	}
+}